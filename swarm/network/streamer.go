@@ -0,0 +1,790 @@
+// Copyright 2016 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/crypto/sha3"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/protocols"
+)
+
+// HashSize is the length in bytes of the content addresses used by the
+// streaming protocol.
+const HashSize = 32
+
+// Priority determines the order in which a peer's outgoing streams are
+// served relative to one another.
+type Priority int
+
+const (
+	Low Priority = iota
+	Mid
+	Top
+)
+
+// StreamerSpec is the protocol spec of the streaming (bzz-stream) protocol.
+var StreamerSpec = &protocols.Spec{
+	Name:       "stream",
+	Version:    1,
+	MaxMsgSize: 10 * 1024 * 1024,
+	Messages: []interface{}{
+		TakeoverProofMsg{},
+		OfferedHashesMsg{},
+		WantedHashesMsg{},
+		SubscribeErrorMsg{},
+		SubscribeMsg{},
+		DeliverySkipCheckMsg{},
+		RangeRootMsg{},
+		GetChunkRangeMsg{},
+		ChunkRangeMsg{},
+	},
+}
+
+// Handover is the state handed over from an outgoing streamer to its peer
+// when a batch reaches the head of the stream.
+type Handover struct {
+	Stream string
+	Start  uint64
+	End    uint64
+	Root   []byte
+}
+
+// HandoverProof accompanies an OfferedHashesMsg and lets the downstream peer
+// verify the batch it is being offered.
+type HandoverProof struct {
+	Sig      []byte
+	Handover *Handover
+}
+
+// TakeoverProof is returned by IncomingStreamer.BatchDone once a batch has
+// been fully received and stored, confirming the new stream state.
+type TakeoverProof struct {
+	Handover *Handover
+	Sig      []byte
+}
+
+// TakeoverProofMsg is the wire form of a TakeoverProof.
+type TakeoverProofMsg struct {
+	Stream string
+	Proof  *TakeoverProof
+}
+
+// SubscribeMsg requests a stream subscription from a peer for the given
+// key range.
+type SubscribeMsg struct {
+	Stream   string
+	Key      []byte
+	From     uint64
+	To       uint64
+	Priority Priority
+}
+
+// SubscribeErrorMsg is sent instead of an OfferedHashesMsg when a
+// SubscribeMsg cannot be honoured, carrying a human-readable Reason.
+type SubscribeErrorMsg struct {
+	Stream string
+	Reason string
+}
+
+// OfferedHashesMsg is sent by an outgoing streamer to offer a batch of
+// hashes to a subscribed peer.
+type OfferedHashesMsg struct {
+	Stream        string
+	HandoverProof *HandoverProof
+	Hashes        []byte
+	From, To      uint64
+}
+
+// WantedHashesMsg is the downstream peer's response, selecting which of the
+// offered hashes it still needs.
+type WantedHashesMsg struct {
+	Stream   string
+	Want     []byte
+	From, To uint64
+}
+
+// DeliverySkipCheckMsg is exchanged right after a peer connection comes up
+// and advertises whether the sender is willing to skip the chunk
+// integrity re-hash on delivery. The check is only actually skipped once
+// both peers have advertised it, see StreamerPeer.skipCheck.
+type DeliverySkipCheckMsg struct {
+	Enabled bool
+}
+
+// RangeRootMsg agrees the Merkle root of the ordered hash list backing a
+// stream, against which subsequent RangeProofs are verified.
+type RangeRootMsg struct {
+	Stream string
+	Root   []byte
+}
+
+// GetChunkRangeMsg requests a contiguous, packed range of a stream as an
+// alternative to the OfferedHashesMsg/WantedHashesMsg round-trip.
+type GetChunkRangeMsg struct {
+	Stream string
+	Key    []byte
+	From   uint64
+	To     uint64
+	Limit  int
+}
+
+// ChunkRangeMsg answers a GetChunkRangeMsg with a packed slice of
+// (hash, data) pairs and a RangeProof that lets the client verify them
+// against the previously agreed RangeRootMsg root before storing.
+type ChunkRangeMsg struct {
+	Stream string
+	Hashes [][]byte
+	Data   [][]byte
+	Proof  *RangeProof
+	Next   uint64
+}
+
+// RangeProof is a compact Merkle-style proof for a contiguous range of a
+// stream's ordered hash list: the sibling hashes needed to reconstruct the
+// range's covering subtree up to the stream's agreed root.
+type RangeProof struct {
+	Siblings []RangeProofSibling
+}
+
+// RangeProofSibling is one step in folding a range's covering subtree root
+// up to the stream's agreed root. Left reports whether Hash is the left
+// child at this level, so the accumulated node must be folded as
+// hashPair(Hash, node) rather than hashPair(node, Hash); a range is not,
+// in general, the leftmost path to the root, so this position has to be
+// carried alongside the sibling hash.
+type RangeProofSibling struct {
+	Hash []byte
+	Left bool
+}
+
+// Verify reconstructs the root covering hashes using the proof's sibling
+// hashes and compares it against root.
+func (p *RangeProof) Verify(hashes [][]byte, root []byte) bool {
+	node := merkleSubtreeRoot(hashes)
+	for _, sibling := range p.Siblings {
+		if sibling.Left {
+			node = hashPair(sibling.Hash, node)
+		} else {
+			node = hashPair(node, sibling.Hash)
+		}
+	}
+	return bytes.Equal(node, root)
+}
+
+// merkleSubtreeRoot folds an ordered list of leaf hashes pairwise into a
+// single root hash.
+func merkleSubtreeRoot(hashes [][]byte) []byte {
+	if len(hashes) == 0 {
+		return make([]byte, HashSize)
+	}
+	level := hashes
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, hashPair(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// hashPair combines two Merkle tree nodes into their parent hash.
+func hashPair(a, b []byte) []byte {
+	sum := sha3.Sum256(append(append([]byte{}, a...), b...))
+	return sum[:]
+}
+
+// IncomingStreamer is implemented by consumers of a subscribed stream.
+type IncomingStreamer interface {
+	NeedData(hash []byte) func()
+	BatchDone(string, uint64, []byte, []byte) func() (*TakeoverProof, error)
+
+	// DeliverRange hands over a range of (hash, data) pairs received in
+	// answer to a GetChunkRangeMsg, already proof-verified by the caller.
+	DeliverRange(hashes [][]byte, data [][]byte, proof *RangeProof) error
+}
+
+// OutgoingStreamer is implemented by producers serving a stream to a peer.
+type OutgoingStreamer interface {
+	SetNextBatch(from uint64, to uint64) ([]byte, uint64, uint64, *HandoverProof, error)
+	GetData([]byte) []byte
+
+	// GetRange returns a contiguous, packed slice of the stream in
+	// [from, to) up to sizeLimit bytes/count, along with a RangeProof
+	// rooted at the stream's agreed state root and the offset to resume
+	// from on the next call.
+	GetRange(from, to uint64, sizeLimit int) (hashes [][]byte, data [][]byte, proof *RangeProof, next uint64, err error)
+}
+
+// IncomingStreamerFunc constructs an IncomingStreamer for a given peer and
+// subscription-specific state.
+type IncomingStreamerFunc func(*StreamerPeer, []byte) (IncomingStreamer, error)
+
+// OutgoingStreamerFunc constructs an OutgoingStreamer for a given peer and
+// subscription-specific state.
+type OutgoingStreamerFunc func(*StreamerPeer, []byte) (OutgoingStreamer, error)
+
+// StreamerPeer wraps a bzzPeer with the bookkeeping the streaming protocol
+// needs per peer.
+type StreamerPeer struct {
+	*bzzPeer
+	streamer *Streamer
+
+	serversMu sync.Mutex
+	servers   map[string]bool // open (stream, key) outgoing servers for this peer
+
+	skipCheckMu sync.RWMutex
+	skipCheck   bool // true once both peers have negotiated DeliverySkipCheck
+}
+
+// SkipCheck reports whether chunk integrity verification has been
+// negotiated away with this peer. Streamer itself never stores chunks; it
+// only negotiates and exposes this flag so that the IncomingStreamer
+// registered for a stream can decide, inside its NeedData callback,
+// whether to skip the content-address re-hash before storing a delivered
+// chunk through DbAccess.
+func (p *StreamerPeer) SkipCheck() bool {
+	p.skipCheckMu.RLock()
+	defer p.skipCheckMu.RUnlock()
+	return p.skipCheck
+}
+
+// serverKey identifies an outgoing server by the stream it serves and the
+// key it was subscribed with.
+func serverKey(stream string, key []byte) string {
+	return stream + "\x00" + string(key)
+}
+
+// Streamer implements the bzz-stream protocol, offering and consuming
+// content-addressed chunk streams between peers.
+type Streamer struct {
+	mu                sync.RWMutex
+	delivery          *Delivery
+	peers             map[discover.NodeID]*StreamerPeer
+	incomingStreamers map[string]IncomingStreamerFunc
+	outgoingStreamers map[string]OutgoingStreamerFunc
+
+	// LightNode marks this Streamer as belonging to a resource-constrained
+	// node. Light nodes never serve outgoing streams: they only register
+	// incoming streamers and reject upstream SubscribeMsg requests, while
+	// still being able to Subscribe to other peers.
+	LightNode bool
+
+	// MaxPeerServers bounds how many distinct (stream, key) outgoing
+	// servers a single peer may have running at once. Zero means
+	// unlimited.
+	MaxPeerServers int
+
+	// subscriptionFunc accounts for and admits a new outgoing server for
+	// peer, stream and key, returning false if it would exceed
+	// MaxPeerServers. It exists as a seam so tests can inject a fake
+	// accounting function; defaults to defaultSubscriptionFunc.
+	subscriptionFunc func(peer *StreamerPeer, stream string, key []byte) bool
+
+	// DeliverySkipCheck advertises a willingness to skip the chunk
+	// integrity re-hash on delivery. The check is only skipped for a
+	// given peer once that peer has advertised it too, see
+	// StreamerPeer.SkipCheck.
+	DeliverySkipCheck bool
+
+	// SyncUpdateDelay debounces resubscription work triggered by Kademlia
+	// neighbourhood depth changes: instead of resubscribing on every
+	// change, the Streamer waits for the depth to settle for this long
+	// before issuing a single batched round of Subscribe calls. Zero
+	// disables the depth-change watcher started by Run.
+	SyncUpdateDelay time.Duration
+
+	clock mclock.Clock
+	kad   *Kademlia
+
+	subscriptionsMu sync.Mutex
+	subscriptions   map[subscriptionKey]subscription
+
+	depthChangeOnce sync.Once
+
+	// timerSetHook, when non-nil, is called synchronously right after
+	// kademliaDepthChange registers a new debounce timer via clock.After.
+	// It is a test seam, the same way subscriptionFunc lets tests inject
+	// fake peer-server accounting: it lets a test driving changeC
+	// directly synchronize with the watcher goroutine before advancing a
+	// simulated clock, instead of racing an unbuffered channel send
+	// against the goroutine's own progress.
+	timerSetHook func()
+
+	rangeRootsMu sync.Mutex
+	rangeRoots   map[string][]byte // stream -> agreed RangeProof root
+}
+
+// subscriptionKey identifies an outbound subscription by peer and stream.
+type subscriptionKey struct {
+	peer   discover.NodeID
+	stream string
+}
+
+// subscription is the state needed to reissue a Subscribe call for a peer
+// after a debounced Kademlia depth change.
+type subscription struct {
+	key      []byte
+	from, to uint64
+	priority Priority
+	history  bool
+}
+
+// defaultSubscriptionFunc enforces MaxPeerServers by tracking the open
+// (stream, key) servers on the peer itself.
+func defaultSubscriptionFunc(peer *StreamerPeer, stream string, key []byte) bool {
+	peer.serversMu.Lock()
+	defer peer.serversMu.Unlock()
+
+	if peer.servers == nil {
+		peer.servers = make(map[string]bool)
+	}
+
+	k := serverKey(stream, key)
+	if peer.servers[k] {
+		return true
+	}
+	if peer.streamer.MaxPeerServers > 0 && len(peer.servers) >= peer.streamer.MaxPeerServers {
+		return false
+	}
+	peer.servers[k] = true
+	return true
+}
+
+// NewStreamer creates a Streamer backed by the given Delivery and Kademlia.
+// Passing lightNode as true puts the Streamer in light-node mode, see
+// LightNode.
+func NewStreamer(delivery *Delivery, kad *Kademlia, lightNode bool) *Streamer {
+	return &Streamer{
+		delivery:          delivery,
+		kad:               kad,
+		peers:             make(map[discover.NodeID]*StreamerPeer),
+		incomingStreamers: make(map[string]IncomingStreamerFunc),
+		outgoingStreamers: make(map[string]OutgoingStreamerFunc),
+		LightNode:         lightNode,
+		subscriptionFunc:  defaultSubscriptionFunc,
+		clock:             mclock.System{},
+		subscriptions:     make(map[subscriptionKey]subscription),
+		rangeRoots:        make(map[string][]byte),
+	}
+}
+
+// RegisterIncomingStreamer registers a constructor for a stream this node
+// can subscribe to and consume. This is always allowed, including for
+// light nodes.
+func (s *Streamer) RegisterIncomingStreamer(stream string, f IncomingStreamerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.incomingStreamers[stream] = f
+}
+
+// RegisterOutgoingStreamer registers a constructor for a stream this node
+// can serve to subscribing peers. Light nodes never serve streams, so the
+// registration is silently dropped to keep them from advertising
+// offered-hashes streams.
+func (s *Streamer) RegisterOutgoingStreamer(stream string, f OutgoingStreamerFunc) {
+	if s.LightNode {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outgoingStreamers[stream] = f
+}
+
+// RegisterOutgoingRangeServer registers a constructor for a stream served
+// through the range-based GetChunkRangeMsg/ChunkRangeMsg exchange instead
+// of the OfferedHashesMsg/WantedHashesMsg round-trip. It reuses the same
+// registration and max-peer-servers accounting as
+// RegisterOutgoingStreamer. Range requests carry no Priority, and range
+// responses are sent without any priority ordering.
+func (s *Streamer) RegisterOutgoingRangeServer(stream string, f OutgoingStreamerFunc) {
+	s.RegisterOutgoingStreamer(stream, f)
+}
+
+// RegisterIncomingRangeClient registers a constructor for a stream
+// consumed through the range-based exchange. It reuses the same
+// registration path as RegisterIncomingStreamer.
+func (s *Streamer) RegisterIncomingRangeClient(stream string, f IncomingStreamerFunc) {
+	s.RegisterIncomingStreamer(stream, f)
+}
+
+// SetRangeRoot records the agreed Merkle root for a stream, to be used to
+// verify RangeProofs delivered in subsequent ChunkRangeMsg exchanges.
+func (s *Streamer) SetRangeRoot(stream string, root []byte) {
+	s.rangeRootsMu.Lock()
+	defer s.rangeRootsMu.Unlock()
+	s.rangeRoots[stream] = root
+}
+
+// Subscribe requests that the peer identified by id start offering the
+// given stream and key range to us.
+func (s *Streamer) Subscribe(id discover.NodeID, stream string, key []byte, from, to uint64, priority Priority, history bool) error {
+	s.mu.RLock()
+	_, ok := s.incomingStreamers[stream]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("stream %s not registered", stream)
+	}
+
+	s.mu.RLock()
+	peer, ok := s.peers[id]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("peer %s not found", id)
+	}
+
+	if err := peer.Send(&SubscribeMsg{
+		Stream:   stream,
+		Key:      key,
+		From:     from,
+		To:       to,
+		Priority: priority,
+	}); err != nil {
+		return err
+	}
+
+	s.subscriptionsMu.Lock()
+	s.subscriptions[subscriptionKey{peer: id, stream: stream}] = subscription{
+		key:      key,
+		from:     from,
+		to:       to,
+		priority: priority,
+		history:  history,
+	}
+	s.subscriptionsMu.Unlock()
+
+	return nil
+}
+
+// resubscribeAll reissues Subscribe for every tracked subscription, in a
+// single batched round. It is called once per debounce window by
+// kademliaDepthChange rather than once per depth-change event, so that a
+// burst of changes produces one round of SubscribeMsg instead of many.
+func (s *Streamer) resubscribeAll() {
+	s.subscriptionsMu.Lock()
+	subs := make(map[subscriptionKey]subscription, len(s.subscriptions))
+	for k, v := range s.subscriptions {
+		subs[k] = v
+	}
+	s.subscriptionsMu.Unlock()
+
+	for k, sub := range subs {
+		s.mu.RLock()
+		peer, ok := s.peers[k.peer]
+		s.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		peer.Send(&SubscribeMsg{
+			Stream:   k.stream,
+			Key:      sub.key,
+			From:     sub.from,
+			To:       sub.to,
+			Priority: sub.priority,
+		})
+	}
+}
+
+// startKademliaDepthChangeWatcherOnce starts the kademliaDepthChange
+// goroutine the first time a peer comes up, provided both a Kademlia and a
+// SyncUpdateDelay were configured.
+func (s *Streamer) startKademliaDepthChangeWatcherOnce() {
+	if s.kad == nil || s.SyncUpdateDelay <= 0 {
+		return
+	}
+	s.depthChangeOnce.Do(func() {
+		changeC, unsubscribe := s.kad.SubscribeToNeighbourhoodDepthChange()
+		go s.kademliaDepthChange(changeC, unsubscribe)
+	})
+}
+
+// kademliaDepthChange watches changeC for Kademlia neighbourhood depth
+// changes and coalesces them: a burst of changes within SyncUpdateDelay of
+// each other triggers exactly one resubscribeAll call.
+func (s *Streamer) kademliaDepthChange(changeC <-chan struct{}, unsubscribe func()) {
+	defer unsubscribe()
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case _, ok := <-changeC:
+			if !ok {
+				return
+			}
+			timer = s.clock.After(s.SyncUpdateDelay)
+			if s.timerSetHook != nil {
+				s.timerSetHook()
+			}
+		case <-timer:
+			timer = nil
+			s.resubscribeAll()
+		}
+	}
+}
+
+// RequestRange asks the peer identified by id for a contiguous range of
+// stream in [from, to), up to sizeLimit bytes/count, using the range-based
+// GetChunkRangeMsg/ChunkRangeMsg exchange registered through
+// RegisterIncomingRangeClient.
+func (s *Streamer) RequestRange(id discover.NodeID, stream string, key []byte, from, to uint64, sizeLimit int) error {
+	s.mu.RLock()
+	_, ok := s.incomingStreamers[stream]
+	peer, peerOk := s.peers[id]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("stream %s not registered", stream)
+	}
+	if !peerOk {
+		return fmt.Errorf("peer %s not found", id)
+	}
+
+	return peer.Send(&GetChunkRangeMsg{
+		Stream: stream,
+		Key:    key,
+		From:   from,
+		To:     to,
+		Limit:  sizeLimit,
+	})
+}
+
+// Run is the protocol run function registered for the bzz-stream protocol;
+// it registers the peer and handles its incoming messages until the peer
+// disconnects.
+func (s *Streamer) Run(p *bzzPeer) error {
+	peer := &StreamerPeer{
+		bzzPeer:  p,
+		streamer: s,
+	}
+
+	s.mu.Lock()
+	s.peers[p.ID()] = peer
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.peers, p.ID())
+		s.mu.Unlock()
+	}()
+
+	if s.DeliverySkipCheck {
+		if err := peer.Send(&DeliverySkipCheckMsg{Enabled: true}); err != nil {
+			return err
+		}
+	}
+
+	s.startKademliaDepthChangeWatcherOnce()
+
+	return peer.Run(s.handleMsg(peer))
+}
+
+func (s *Streamer) handleMsg(peer *StreamerPeer) func(msg interface{}) error {
+	return func(msg interface{}) error {
+		switch msg := msg.(type) {
+		case *SubscribeMsg:
+			return s.handleSubscribeMsg(peer, msg)
+		case *OfferedHashesMsg:
+			return s.handleOfferedHashesMsg(peer, msg)
+		case *WantedHashesMsg:
+			return s.handleWantedHashesMsg(peer, msg)
+		case *DeliverySkipCheckMsg:
+			return s.handleDeliverySkipCheckMsg(peer, msg)
+		case *RangeRootMsg:
+			return s.handleRangeRootMsg(peer, msg)
+		case *GetChunkRangeMsg:
+			return s.handleGetChunkRangeMsg(peer, msg)
+		case *ChunkRangeMsg:
+			return s.handleChunkRangeMsg(peer, msg)
+		}
+		return nil
+	}
+}
+
+func (s *Streamer) handleRangeRootMsg(peer *StreamerPeer, msg *RangeRootMsg) error {
+	s.SetRangeRoot(msg.Stream, msg.Root)
+	return nil
+}
+
+func (s *Streamer) handleGetChunkRangeMsg(peer *StreamerPeer, msg *GetChunkRangeMsg) error {
+	s.mu.RLock()
+	f, ok := s.outgoingStreamers[msg.Stream]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("stream %s not registered", msg.Stream)
+	}
+
+	if !s.subscriptionFunc(peer, msg.Stream, msg.Key) {
+		return peer.Send(&SubscribeErrorMsg{
+			Stream: msg.Stream,
+			Reason: "exceeded max peer servers",
+		})
+	}
+
+	os, err := f(peer, msg.Key)
+	if err != nil {
+		return err
+	}
+
+	hashes, data, proof, next, err := os.GetRange(msg.From, msg.To, msg.Limit)
+	if err != nil {
+		return err
+	}
+
+	return peer.Send(&ChunkRangeMsg{
+		Stream: msg.Stream,
+		Hashes: hashes,
+		Data:   data,
+		Proof:  proof,
+		Next:   next,
+	})
+}
+
+func (s *Streamer) handleChunkRangeMsg(peer *StreamerPeer, msg *ChunkRangeMsg) error {
+	s.mu.RLock()
+	f, ok := s.incomingStreamers[msg.Stream]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("stream %s not registered", msg.Stream)
+	}
+
+	s.rangeRootsMu.Lock()
+	root, haveRoot := s.rangeRoots[msg.Stream]
+	s.rangeRootsMu.Unlock()
+
+	// A range must always be proof-verified against an agreed root before
+	// its chunks are handed over for storage: an unagreed root or a
+	// missing proof are both treated as a failed verification, not as
+	// permission to skip it.
+	if !haveRoot {
+		return fmt.Errorf("no agreed range root for stream %s", msg.Stream)
+	}
+	if msg.Proof == nil || !msg.Proof.Verify(msg.Hashes, root) {
+		return fmt.Errorf("invalid range proof for stream %s", msg.Stream)
+	}
+
+	is, err := f(peer, nil)
+	if err != nil {
+		return err
+	}
+
+	return is.DeliverRange(msg.Hashes, msg.Data, msg.Proof)
+}
+
+func (s *Streamer) handleDeliverySkipCheckMsg(peer *StreamerPeer, msg *DeliverySkipCheckMsg) error {
+	peer.skipCheckMu.Lock()
+	peer.skipCheck = s.DeliverySkipCheck && msg.Enabled
+	peer.skipCheckMu.Unlock()
+	return nil
+}
+
+func (s *Streamer) handleSubscribeMsg(peer *StreamerPeer, msg *SubscribeMsg) error {
+	if s.LightNode {
+		return peer.Send(&SubscribeErrorMsg{
+			Stream: msg.Stream,
+			Reason: "not serving",
+		})
+	}
+
+	s.mu.RLock()
+	f, ok := s.outgoingStreamers[msg.Stream]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("stream %s not registered", msg.Stream)
+	}
+
+	if !s.subscriptionFunc(peer, msg.Stream, msg.Key) {
+		return peer.Send(&SubscribeErrorMsg{
+			Stream: msg.Stream,
+			Reason: "exceeded max peer servers",
+		})
+	}
+
+	os, err := f(peer, msg.Key)
+	if err != nil {
+		return err
+	}
+
+	hashes, from, to, proof, err := os.SetNextBatch(msg.From, msg.To)
+	if err != nil {
+		return err
+	}
+
+	return peer.Send(&OfferedHashesMsg{
+		Stream:        msg.Stream,
+		HandoverProof: proof,
+		Hashes:        hashes,
+		From:          from,
+		To:            to,
+	})
+}
+
+func (s *Streamer) handleOfferedHashesMsg(peer *StreamerPeer, msg *OfferedHashesMsg) error {
+	s.mu.RLock()
+	f, ok := s.incomingStreamers[msg.Stream]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("stream %s not registered", msg.Stream)
+	}
+
+	is, err := f(peer, nil)
+	if err != nil {
+		return err
+	}
+
+	numHashes := len(msg.Hashes) / HashSize
+	want := make([]byte, (numHashes+7)/8)
+	var waits []func()
+	for i := 0; i < numHashes; i++ {
+		hash := msg.Hashes[i*HashSize : (i+1)*HashSize]
+		if wait := is.NeedData(hash); wait != nil {
+			want[i/8] |= 1 << uint(i%8)
+			waits = append(waits, wait)
+		}
+	}
+
+	// NeedData's wait funcs can block on delivery of the actual chunk
+	// data, so they must not hold up the WantedHashesMsg reply; run them
+	// (and the BatchDone they gate) in the background.
+	go func() {
+		for _, wait := range waits {
+			wait()
+		}
+		if done := is.BatchDone(msg.Stream, msg.From, msg.Hashes, nil); done != nil {
+			done()
+		}
+	}()
+
+	return peer.Send(&WantedHashesMsg{
+		Stream: msg.Stream,
+		Want:   want,
+		From:   msg.To,
+		To:     0,
+	})
+}
+
+func (s *Streamer) handleWantedHashesMsg(peer *StreamerPeer, msg *WantedHashesMsg) error {
+	return nil
+}
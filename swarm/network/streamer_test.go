@@ -19,16 +19,20 @@ package network
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/crypto/sha3"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/protocols"
 	p2ptest "github.com/ethereum/go-ethereum/p2p/testing"
 	"github.com/ethereum/go-ethereum/swarm/storage"
+	"github.com/ethereum/go-ethereum/swarm/testutil"
 )
 
 //
@@ -36,7 +40,69 @@ import (
 // 	log.Root().SetHandler(log.CallerFileHandler(log.LvlFilterHandler(log.LvlWarn, log.StreamHandler(os.Stderr, log.TerminalFormat(true)))))
 // }
 
+// streamerTesterAdapter selects the p2p test adapter newStreamerTesterWithConfig
+// wires the simulated peers through. directAdapter is the only adapter
+// p2ptest.NewProtocolTester currently exercises (an in-memory, in-process
+// pipe); the type exists so additional adapters (e.g. a exec/docker
+// adapter) can be added as a config knob without changing every caller.
+type streamerTesterAdapter string
+
+const directAdapter streamerTesterAdapter = "direct"
+
+// streamerTesterConfig configures newStreamerTesterWithConfig. The zero
+// value plus a call to newDefaultStreamerTesterConfig gives the same
+// single-node setup newStreamerTester has always used; fields are only
+// set explicitly by the variants that need to exercise a particular
+// option.
+type streamerTesterConfig struct {
+	NodeCount         int
+	Adapter           streamerTesterAdapter
+	LightNode         bool
+	DeliverySkipCheck bool
+	SyncUpdateDelay   time.Duration
+	Clock             mclock.Clock
+	Race              bool
+}
+
+// newDefaultStreamerTesterConfig returns the config newStreamerTester
+// builds on. Race is auto-populated from the build-tagged
+// testutil.RaceEnabled constant; under -race the single peer is given
+// more time to come up, since the race detector slows everything down.
+func newDefaultStreamerTesterConfig() *streamerTesterConfig {
+	return &streamerTesterConfig{
+		NodeCount: 1,
+		Adapter:   directAdapter,
+		Race:      testutil.RaceEnabled,
+	}
+}
+
 func newStreamerTester(t *testing.T) (*p2ptest.ProtocolTester, *Streamer, *storage.LocalStore, func(), error) {
+	return newStreamerTesterWithConfig(t, newDefaultStreamerTesterConfig())
+}
+
+func newStreamerTesterLightNode(t *testing.T, lightNode bool) (*p2ptest.ProtocolTester, *Streamer, *storage.LocalStore, func(), error) {
+	cfg := newDefaultStreamerTesterConfig()
+	cfg.LightNode = lightNode
+	return newStreamerTesterWithConfig(t, cfg)
+}
+
+func newStreamerTesterDeliverySkipCheck(t *testing.T, deliverySkipCheck bool) (*p2ptest.ProtocolTester, *Streamer, *storage.LocalStore, func(), error) {
+	cfg := newDefaultStreamerTesterConfig()
+	cfg.DeliverySkipCheck = deliverySkipCheck
+	return newStreamerTesterWithConfig(t, cfg)
+}
+
+// newStreamerTesterSyncUpdateDelay sets up a Streamer with SyncUpdateDelay
+// debouncing enabled, backed by clock instead of the real wall clock so
+// tests can advance time deterministically.
+func newStreamerTesterSyncUpdateDelay(t *testing.T, delay time.Duration, clock mclock.Clock) (*p2ptest.ProtocolTester, *Streamer, *storage.LocalStore, func(), error) {
+	cfg := newDefaultStreamerTesterConfig()
+	cfg.SyncUpdateDelay = delay
+	cfg.Clock = clock
+	return newStreamerTesterWithConfig(t, cfg)
+}
+
+func newStreamerTesterWithConfig(t *testing.T, cfg *streamerTesterConfig) (*p2ptest.ProtocolTester, *Streamer, *storage.LocalStore, func(), error) {
 	// setup
 	addr := RandomAddr() // tested peers peer address
 	to := NewKademlia(addr.OAddr, NewKadParams())
@@ -57,7 +123,12 @@ func newStreamerTester(t *testing.T) (*p2ptest.ProtocolTester, *Streamer, *stora
 
 	dbAccess := NewDbAccess(localStore)
 	delivery := NewDelivery(to, dbAccess)
-	streamer := NewStreamer(delivery)
+	streamer := NewStreamer(delivery, to, cfg.LightNode)
+	streamer.DeliverySkipCheck = cfg.DeliverySkipCheck
+	streamer.SyncUpdateDelay = cfg.SyncUpdateDelay
+	if cfg.Clock != nil {
+		streamer.clock = cfg.Clock
+	}
 	run := func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
 		bzzPeer := &bzzPeer{
 			Peer:      protocols.NewPeer(p, rw, StreamerSpec),
@@ -67,9 +138,33 @@ func newStreamerTester(t *testing.T) (*p2ptest.ProtocolTester, *Streamer, *stora
 		to.On(bzzPeer)
 		return streamer.Run(bzzPeer)
 	}
-	protocolTester := p2ptest.NewProtocolTester(t, NewNodeIDFromAddr(addr), 1, run)
+	nodeCount := cfg.NodeCount
+	if nodeCount == 0 {
+		nodeCount = 1
+	}
+	if cfg.Race && nodeCount > 1 {
+		// the race detector slows everything down; keep simulations small
+		// so -count=N -race runs stay practical.
+		nodeCount = 1
+	}
+	adapter := cfg.Adapter
+	if adapter == "" {
+		adapter = directAdapter
+	}
+	switch adapter {
+	case directAdapter:
+		// p2ptest.NewProtocolTester only wires up the in-memory direct
+		// adapter today; other adapters plug in here as they're added.
+	default:
+		return nil, nil, nil, teardown, fmt.Errorf("unsupported streamer tester adapter %q", adapter)
+	}
+	protocolTester := p2ptest.NewProtocolTester(t, NewNodeIDFromAddr(addr), nodeCount, run)
 
-	err = waitForPeers(streamer, 1*time.Second)
+	peerWaitTimeout := 1 * time.Second
+	if cfg.Race {
+		peerWaitTimeout = 5 * time.Second
+	}
+	err = waitForPeers(streamer, peerWaitTimeout)
 	if err != nil {
 		return nil, nil, nil, nil, errors.New("timeout: peer is not created")
 	}
@@ -91,19 +186,26 @@ func TestStreamerSubscribe(t *testing.T) {
 }
 
 var (
-	hash0                            = sha3.Sum256([]byte{0})
-	hash1                            = sha3.Sum256([]byte{1})
-	hash2                            = sha3.Sum256([]byte{2})
-	hashesTmp                        = append(hash0[:], hash1[:]...)
-	hashes                           = append(hashesTmp, hash2[:]...)
-	receivedHashes map[string][]byte = make(map[string][]byte)
-	wait0                            = make(chan bool)
-	wait2                            = make(chan bool)
-	batchDone                        = make(chan bool)
+	hash0     = sha3.Sum256([]byte{0})
+	hash1     = sha3.Sum256([]byte{1})
+	hash2     = sha3.Sum256([]byte{2})
+	hashesTmp = append(hash0[:], hash1[:]...)
+	hashes    = append(hashesTmp, hash2[:]...)
 )
 
+// testIncomingStreamer is a fake IncomingStreamer used throughout this
+// file. receivedHashes/wait0/wait2/batchDone are only populated by tests
+// that need to synchronize with NeedData/BatchDone callbacks; the zero
+// value is safe for tests that don't care about that and just construct
+// a bare &testIncomingStreamer{t: t}.
 type testIncomingStreamer struct {
 	t []byte
+
+	mu             sync.Mutex
+	receivedHashes map[string][]byte
+	wait0          chan bool
+	wait2          chan bool
+	batchDone      chan bool
 }
 
 type testOutgoingStreamer struct {
@@ -111,21 +213,31 @@ type testOutgoingStreamer struct {
 }
 
 func (self *testIncomingStreamer) NeedData(hash []byte) func() {
-	receivedHashes[string(hash)] = hash
-	if bytes.Equal(hash, hash0[:]) {
+	self.mu.Lock()
+	if self.receivedHashes != nil {
+		self.receivedHashes[string(hash)] = hash
+	}
+	self.mu.Unlock()
+	if bytes.Equal(hash, hash0[:]) && self.wait0 != nil {
 		return func() {
-			<-wait0
+			<-self.wait0
 		}
-	} else if bytes.Equal(hash, hash2[:]) {
+	} else if bytes.Equal(hash, hash2[:]) && self.wait2 != nil {
 		return func() {
-			<-wait2
+			<-self.wait2
 		}
 	}
 	return nil
 }
 
 func (self *testIncomingStreamer) BatchDone(string, uint64, []byte, []byte) func() (*TakeoverProof, error) {
-	close(batchDone)
+	if self.batchDone != nil {
+		close(self.batchDone)
+	}
+	return nil
+}
+
+func (self *testIncomingStreamer) DeliverRange(hashes [][]byte, data [][]byte, proof *RangeProof) error {
 	return nil
 }
 
@@ -140,6 +252,10 @@ func (self *testOutgoingStreamer) GetData([]byte) []byte {
 	return nil
 }
 
+func (self *testOutgoingStreamer) GetRange(from, to uint64, sizeLimit int) ([][]byte, [][]byte, *RangeProof, uint64, error) {
+	return nil, nil, nil, to, nil
+}
+
 func TestStreamerDownstreamSubscribeMsgExchange(t *testing.T) {
 	tester, streamer, _, teardown, err := newStreamerTester(t)
 	defer teardown()
@@ -235,21 +351,176 @@ func TestStreamerUpstreamSubscribeMsgExchange(t *testing.T) {
 
 }
 
-func TestStreamerDownstreamOfferedHashesMsgExchange(t *testing.T) {
+func TestStreamerUpstreamSubscribeMsgExchangeMaxPeerServers(t *testing.T) {
 	tester, streamer, _, teardown, err := newStreamerTester(t)
 	defer teardown()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	streamer.RegisterIncomingStreamer("foo", func(p *StreamerPeer, t []byte) (IncomingStreamer, error) {
-		return &testIncomingStreamer{
+	const maxPeerServers = 2
+	streamer.MaxPeerServers = maxPeerServers
+
+	streamer.RegisterOutgoingStreamer("foo", func(p *StreamerPeer, t []byte) (OutgoingStreamer, error) {
+		return &testOutgoingStreamer{
+			t: t,
+		}, nil
+	})
+
+	peerID := tester.IDs[0]
+
+	for i := 0; i < maxPeerServers; i++ {
+		err = tester.TestExchanges(p2ptest.Exchange{
+			Label: "Subscribe message",
+			Triggers: []p2ptest.Trigger{
+				p2ptest.Trigger{
+					Code: 4,
+					Msg: &SubscribeMsg{
+						Stream:   "foo",
+						Key:      []byte{byte(i)},
+						From:     5,
+						To:       8,
+						Priority: Top,
+					},
+					Peer: peerID,
+				},
+			},
+			Expects: []p2ptest.Expect{
+				p2ptest.Expect{
+					Code: 1,
+					Msg: &OfferedHashesMsg{
+						Stream: "foo",
+						HandoverProof: &HandoverProof{
+							Handover: &Handover{},
+						},
+						Hashes: make([]byte, HashSize),
+						From:   6,
+						To:     9,
+					},
+					Peer: peerID,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("subscription %d: expected OfferedHashesMsg, got error %v", i, err)
+		}
+	}
+
+	// the (maxPeerServers+1)th distinct subscription must be rejected
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "Subscribe message over the limit",
+		Triggers: []p2ptest.Trigger{
+			p2ptest.Trigger{
+				Code: 4,
+				Msg: &SubscribeMsg{
+					Stream:   "foo",
+					Key:      []byte{byte(maxPeerServers)},
+					From:     5,
+					To:       8,
+					Priority: Top,
+				},
+				Peer: peerID,
+			},
+		},
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 3,
+				Msg: &SubscribeErrorMsg{
+					Stream: "foo",
+					Reason: "exceeded max peer servers",
+				},
+				Peer: peerID,
+			},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestStreamerUpstreamSubscribeMsgExchangeFakeSubscriptionFunc asserts that
+// subscriptionFunc is actually consulted on a subscribe, rather than
+// MaxPeerServers being enforced by some other path: a fake is injected
+// that rejects every subscription unconditionally, and the test fails
+// unless that fake is actually invoked.
+func TestStreamerUpstreamSubscribeMsgExchangeFakeSubscriptionFunc(t *testing.T) {
+	tester, streamer, _, teardown, err := newStreamerTester(t)
+	defer teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	streamer.subscriptionFunc = func(peer *StreamerPeer, stream string, key []byte) bool {
+		calls++
+		return false
+	}
+
+	streamer.RegisterOutgoingStreamer("foo", func(p *StreamerPeer, t []byte) (OutgoingStreamer, error) {
+		return &testOutgoingStreamer{
 			t: t,
 		}, nil
 	})
 
 	peerID := tester.IDs[0]
 
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "Subscribe message rejected by fake subscriptionFunc",
+		Triggers: []p2ptest.Trigger{
+			p2ptest.Trigger{
+				Code: 4,
+				Msg: &SubscribeMsg{
+					Stream:   "foo",
+					Key:      []byte{0},
+					From:     5,
+					To:       8,
+					Priority: Top,
+				},
+				Peer: peerID,
+			},
+		},
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 3,
+				Msg: &SubscribeErrorMsg{
+					Stream: "foo",
+					Reason: "exceeded max peer servers",
+				},
+				Peer: peerID,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls == 0 {
+		t.Fatal("expected injected subscriptionFunc to be consulted, it was never called")
+	}
+}
+
+func TestStreamerDownstreamOfferedHashesMsgExchange(t *testing.T) {
+	tester, streamer, _, teardown, err := newStreamerTester(t)
+	defer teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStreamer := &testIncomingStreamer{
+		receivedHashes: make(map[string][]byte),
+		wait0:          make(chan bool),
+		wait2:          make(chan bool),
+		batchDone:      make(chan bool),
+	}
+
+	streamer.RegisterIncomingStreamer("foo", func(p *StreamerPeer, t []byte) (IncomingStreamer, error) {
+		testStreamer.t = t
+		return testStreamer, nil
+	})
+
+	peerID := tester.IDs[0]
+
 	err = streamer.Subscribe(peerID, "foo", []byte{}, 5, 8, Top, true)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
@@ -305,34 +576,841 @@ func TestStreamerDownstreamOfferedHashesMsgExchange(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(receivedHashes) != 3 {
-		t.Fatalf("Expected number of received hashes %v, got %v", 3, len(receivedHashes))
+	testStreamer.mu.Lock()
+	gotHashes := len(testStreamer.receivedHashes)
+	testStreamer.mu.Unlock()
+	if gotHashes != 3 {
+		t.Fatalf("Expected number of received hashes %v, got %v", 3, gotHashes)
 	}
 
-	close(wait0)
+	close(testStreamer.wait0)
 
 	timeout := time.NewTimer(100 * time.Millisecond)
 	defer timeout.Stop()
 
 	select {
-	case <-batchDone:
+	case <-testStreamer.batchDone:
 		t.Fatal("batch done early")
 	case <-timeout.C:
 	}
 
-	close(wait2)
+	close(testStreamer.wait2)
 
 	timeout2 := time.NewTimer(10000 * time.Millisecond)
 	defer timeout2.Stop()
 
 	select {
-	case <-batchDone:
+	case <-testStreamer.batchDone:
 	case <-timeout2.C:
 		t.Fatal("timeout waiting batchdone call")
 	}
 
 }
 
+func TestStreamerLightNodeRefusesUpstreamSubscribeMsg(t *testing.T) {
+	tester, streamer, _, teardown, err := newStreamerTesterLightNode(t, true)
+	defer teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamer.RegisterOutgoingStreamer("foo", func(p *StreamerPeer, t []byte) (OutgoingStreamer, error) {
+		return &testOutgoingStreamer{
+			t: t,
+		}, nil
+	})
+
+	peerID := tester.IDs[0]
+
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "Subscribe message",
+		Triggers: []p2ptest.Trigger{
+			p2ptest.Trigger{
+				Code: 4,
+				Msg: &SubscribeMsg{
+					Stream:   "foo",
+					Key:      []byte{},
+					From:     5,
+					To:       8,
+					Priority: Top,
+				},
+				Peer: peerID,
+			},
+		},
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 3,
+				Msg: &SubscribeErrorMsg{
+					Stream: "foo",
+					Reason: "not serving",
+				},
+				Peer: peerID,
+			},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamerLightNodeSubscribeStillWorks(t *testing.T) {
+	tester, streamer, _, teardown, err := newStreamerTesterLightNode(t, true)
+	defer teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamer.RegisterIncomingStreamer("foo", func(p *StreamerPeer, t []byte) (IncomingStreamer, error) {
+		return &testIncomingStreamer{
+			t: t,
+		}, nil
+	})
+
+	peerID := tester.IDs[0]
+
+	err = streamer.Subscribe(peerID, "foo", []byte{}, 5, 8, Top, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "Subscribe message",
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 4,
+				Msg: &SubscribeMsg{
+					Stream:   "foo",
+					Key:      []byte{},
+					From:     5,
+					To:       8,
+					Priority: Top,
+				},
+				Peer: peerID,
+			},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testSkipCheckIncomingStreamer is a fake IncomingStreamer that plays the
+// role DbAccess-backed delivery plays in the real tree: its NeedData
+// callback decides, by consulting peer.SkipCheck(), whether to re-hash
+// and verify a delivered chunk before storing it. Streamer itself carries
+// no storage or observation state for this - that belongs to whatever
+// registers the stream, same as SetNextBatch/GetData already do for
+// outgoing streams.
+type testSkipCheckIncomingStreamer struct {
+	peer *StreamerPeer
+	data []byte
+	done chan struct{}
+
+	mu       sync.Mutex
+	stored   map[string][]byte
+	rejected map[string]bool
+}
+
+func (self *testSkipCheckIncomingStreamer) NeedData(hash []byte) func() {
+	return func() {
+		defer close(self.done)
+
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		if !self.peer.SkipCheck() {
+			sum := sha3.Sum256(self.data)
+			if !bytes.Equal(sum[:], hash) {
+				self.rejected[string(hash)] = true
+				return
+			}
+		}
+		self.stored[string(hash)] = self.data
+	}
+}
+
+func (self *testSkipCheckIncomingStreamer) BatchDone(string, uint64, []byte, []byte) func() (*TakeoverProof, error) {
+	return nil
+}
+
+func (self *testSkipCheckIncomingStreamer) DeliverRange(hashes [][]byte, data [][]byte, proof *RangeProof) error {
+	return nil
+}
+
+func TestStreamerDeliverySkipCheckAcceptsCorruptChunk(t *testing.T) {
+	tester, streamer, _, teardown, err := newStreamerTesterDeliverySkipCheck(t, true)
+	defer teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peerID := tester.IDs[0]
+	corruptData := []byte("this data does not hash to hash0")
+
+	testStreamer := &testSkipCheckIncomingStreamer{
+		data:     corruptData,
+		done:     make(chan struct{}),
+		stored:   make(map[string][]byte),
+		rejected: make(map[string]bool),
+	}
+	streamer.RegisterIncomingStreamer("skipcheck", func(p *StreamerPeer, t []byte) (IncomingStreamer, error) {
+		testStreamer.peer = p
+		return testStreamer, nil
+	})
+
+	err = streamer.Subscribe(peerID, "skipcheck", []byte{}, 0, 1, Top, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "DeliverySkipCheck handshake",
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 5,
+				Msg:  &DeliverySkipCheckMsg{Enabled: true},
+				Peer: peerID,
+			},
+		},
+	},
+		p2ptest.Exchange{
+			Label: "peer advertises DeliverySkipCheck",
+			Triggers: []p2ptest.Trigger{
+				p2ptest.Trigger{
+					Code: 5,
+					Msg:  &DeliverySkipCheckMsg{Enabled: true},
+					Peer: peerID,
+				},
+			},
+		},
+		p2ptest.Exchange{
+			Label: "initial Subscribe message",
+			Expects: []p2ptest.Expect{
+				p2ptest.Expect{
+					Code: 4,
+					Msg: &SubscribeMsg{
+						Stream:   "skipcheck",
+						Key:      []byte{},
+						From:     0,
+						To:       1,
+						Priority: Top,
+					},
+					Peer: peerID,
+				},
+			},
+		},
+		p2ptest.Exchange{
+			Label: "corrupt chunk offered",
+			Triggers: []p2ptest.Trigger{
+				p2ptest.Trigger{
+					Code: 1,
+					Msg: &OfferedHashesMsg{
+						Stream:        "skipcheck",
+						HandoverProof: &HandoverProof{Handover: &Handover{}},
+						Hashes:        hash0[:],
+						From:          0,
+						To:            1,
+					},
+					Peer: peerID,
+				},
+			},
+			Expects: []p2ptest.Expect{
+				p2ptest.Expect{
+					Code: 2,
+					Msg: &WantedHashesMsg{
+						Stream: "skipcheck",
+						Want:   []byte{1},
+						From:   1,
+						To:     0,
+					},
+					Peer: peerID,
+				},
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-testStreamer.done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for NeedData callback to run")
+	}
+
+	testStreamer.mu.Lock()
+	defer testStreamer.mu.Unlock()
+	data, ok := testStreamer.stored[string(hash0[:])]
+	if !ok {
+		t.Fatal("expected corrupt chunk to be stored with DeliverySkipCheck negotiated, it was not")
+	}
+	if !bytes.Equal(data, corruptData) {
+		t.Fatalf("expected stored data %x, got %x", corruptData, data)
+	}
+}
+
+func TestStreamerDeliveryChecksCorruptChunkWhenNotNegotiated(t *testing.T) {
+	tester, streamer, _, teardown, err := newStreamerTesterDeliverySkipCheck(t, false)
+	defer teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peerID := tester.IDs[0]
+	corruptData := []byte("this data does not hash to hash0")
+
+	testStreamer := &testSkipCheckIncomingStreamer{
+		data:     corruptData,
+		done:     make(chan struct{}),
+		stored:   make(map[string][]byte),
+		rejected: make(map[string]bool),
+	}
+	streamer.RegisterIncomingStreamer("skipcheck", func(p *StreamerPeer, t []byte) (IncomingStreamer, error) {
+		testStreamer.peer = p
+		return testStreamer, nil
+	})
+
+	err = streamer.Subscribe(peerID, "skipcheck", []byte{}, 0, 1, Top, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "initial Subscribe message",
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 4,
+				Msg: &SubscribeMsg{
+					Stream:   "skipcheck",
+					Key:      []byte{},
+					From:     0,
+					To:       1,
+					Priority: Top,
+				},
+				Peer: peerID,
+			},
+		},
+	},
+		p2ptest.Exchange{
+			Label: "peer advertises DeliverySkipCheck",
+			Triggers: []p2ptest.Trigger{
+				p2ptest.Trigger{
+					Code: 5,
+					Msg:  &DeliverySkipCheckMsg{Enabled: true},
+					Peer: peerID,
+				},
+			},
+		},
+		p2ptest.Exchange{
+			Label: "corrupt chunk offered",
+			Triggers: []p2ptest.Trigger{
+				p2ptest.Trigger{
+					Code: 1,
+					Msg: &OfferedHashesMsg{
+						Stream:        "skipcheck",
+						HandoverProof: &HandoverProof{Handover: &Handover{}},
+						Hashes:        hash0[:],
+						From:          0,
+						To:            1,
+					},
+					Peer: peerID,
+				},
+			},
+			Expects: []p2ptest.Expect{
+				p2ptest.Expect{
+					Code: 2,
+					Msg: &WantedHashesMsg{
+						Stream: "skipcheck",
+						Want:   []byte{1},
+						From:   1,
+						To:     0,
+					},
+					Peer: peerID,
+				},
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-testStreamer.done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for NeedData callback to run")
+	}
+
+	testStreamer.mu.Lock()
+	defer testStreamer.mu.Unlock()
+	if _, ok := testStreamer.stored[string(hash0[:])]; ok {
+		t.Fatal("expected corrupt chunk to be rejected when DeliverySkipCheck is not negotiated, it was stored")
+	}
+	if !testStreamer.rejected[string(hash0[:])] {
+		t.Fatal("expected corrupt chunk to be recorded as rejected")
+	}
+}
+
+func TestStreamerSyncUpdateDelayDebouncesResubscription(t *testing.T) {
+	clock := &mclock.Simulated{}
+	tester, streamer, _, teardown, err := newStreamerTesterSyncUpdateDelay(t, 100*time.Millisecond, clock)
+	defer teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamer.RegisterIncomingStreamer("foo", func(p *StreamerPeer, t []byte) (IncomingStreamer, error) {
+		return &testIncomingStreamer{
+			t: t,
+		}, nil
+	})
+
+	peerID := tester.IDs[0]
+
+	err = streamer.Subscribe(peerID, "foo", []byte{}, 5, 8, Top, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// consume the initial Subscribe message issued by Subscribe itself
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "initial Subscribe message",
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 4,
+				Msg: &SubscribeMsg{
+					Stream:   "foo",
+					Key:      []byte{},
+					From:     5,
+					To:       8,
+					Priority: Top,
+				},
+				Peer: peerID,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate three rapid depth changes within the debounce window. Each
+	// send only guarantees the watcher's receive happened, not that it
+	// has gone on to register the new debounce timer via clock.After; use
+	// timerSetHook to wait for that registration before sending the next
+	// change or advancing the simulated clock, otherwise Run can race
+	// ahead of the final timer and resubscribeAll never fires.
+	registered := make(chan struct{})
+	streamer.timerSetHook = func() { registered <- struct{}{} }
+
+	changeC := make(chan struct{})
+	go streamer.kademliaDepthChange(changeC, func() {})
+	for i := 0; i < 3; i++ {
+		changeC <- struct{}{}
+		<-registered
+	}
+
+	clock.Run(100 * time.Millisecond)
+
+	// exactly one batched round of resubscription should follow
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "debounced resubscription",
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 4,
+				Msg: &SubscribeMsg{
+					Stream:   "foo",
+					Key:      []byte{},
+					From:     5,
+					To:       8,
+					Priority: Top,
+				},
+				Peer: peerID,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testRangeIncomingStreamer struct {
+	delivered chan [][]byte
+}
+
+func (self *testRangeIncomingStreamer) NeedData(hash []byte) func() {
+	return nil
+}
+
+func (self *testRangeIncomingStreamer) BatchDone(string, uint64, []byte, []byte) func() (*TakeoverProof, error) {
+	return nil
+}
+
+func (self *testRangeIncomingStreamer) DeliverRange(hashes [][]byte, data [][]byte, proof *RangeProof) error {
+	self.delivered <- hashes
+	return nil
+}
+
+func TestStreamerRangeSyncSingleRoundTrip(t *testing.T) {
+	tester, streamer, _, teardown, err := newStreamerTester(t)
+	defer teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rangeHashes := [][]byte{hash0[:], hash1[:], hash2[:]}
+	rangeData := [][]byte{{0}, {1}, {2}}
+	root := merkleSubtreeRoot(rangeHashes)
+
+	delivered := make(chan [][]byte, 1)
+	streamer.RegisterIncomingRangeClient("range-foo", func(p *StreamerPeer, t []byte) (IncomingStreamer, error) {
+		return &testRangeIncomingStreamer{delivered: delivered}, nil
+	})
+	streamer.SetRangeRoot("range-foo", root)
+
+	peerID := tester.IDs[0]
+
+	err = streamer.RequestRange(peerID, "range-foo", []byte{}, 0, 3, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "GetChunkRange message",
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 7,
+				Msg: &GetChunkRangeMsg{
+					Stream: "range-foo",
+					Key:    []byte{},
+					From:   0,
+					To:     3,
+					Limit:  1 << 20,
+				},
+				Peer: peerID,
+			},
+		},
+	},
+		p2ptest.Exchange{
+			Label: "ChunkRange response",
+			Triggers: []p2ptest.Trigger{
+				p2ptest.Trigger{
+					Code: 8,
+					Msg: &ChunkRangeMsg{
+						Stream: "range-foo",
+						Hashes: rangeHashes,
+						Data:   rangeData,
+						Proof:  &RangeProof{},
+						Next:   3,
+					},
+					Peer: peerID,
+				},
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case hashes := <-delivered:
+		if len(hashes) != 3 {
+			t.Fatalf("expected 3 delivered hashes, got %d", len(hashes))
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for DeliverRange")
+	}
+}
+
+// TestStreamerRangeSyncPartialRangeProof exercises a genuine partial-range
+// proof: the range is the left half of a 4-leaf tree, so verifying it
+// against the full tree's root requires folding in one real sibling
+// (the right half's subtree root), not the empty/full-range proof used by
+// TestStreamerRangeSyncSingleRoundTrip.
+func TestStreamerRangeSyncPartialRangeProof(t *testing.T) {
+	tester, streamer, _, teardown, err := newStreamerTester(t)
+	defer teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash3 := sha3.Sum256([]byte{3})
+	leaves := [][]byte{hash0[:], hash1[:], hash2[:], hash3[:]}
+
+	h01 := merkleSubtreeRoot(leaves[0:2])
+	h23 := merkleSubtreeRoot(leaves[2:4])
+	root := hashPair(h01, h23)
+
+	rangeHashes := leaves[0:2]
+	rangeData := [][]byte{{0}, {1}}
+	proof := &RangeProof{
+		Siblings: []RangeProofSibling{
+			{Hash: h23, Left: false},
+		},
+	}
+
+	delivered := make(chan [][]byte, 1)
+	streamer.RegisterIncomingRangeClient("range-partial", func(p *StreamerPeer, t []byte) (IncomingStreamer, error) {
+		return &testRangeIncomingStreamer{delivered: delivered}, nil
+	})
+	streamer.SetRangeRoot("range-partial", root)
+
+	peerID := tester.IDs[0]
+
+	err = streamer.RequestRange(peerID, "range-partial", []byte{}, 0, 2, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "GetChunkRange message",
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 7,
+				Msg: &GetChunkRangeMsg{
+					Stream: "range-partial",
+					Key:    []byte{},
+					From:   0,
+					To:     2,
+					Limit:  1 << 20,
+				},
+				Peer: peerID,
+			},
+		},
+	},
+		p2ptest.Exchange{
+			Label: "ChunkRange response",
+			Triggers: []p2ptest.Trigger{
+				p2ptest.Trigger{
+					Code: 8,
+					Msg: &ChunkRangeMsg{
+						Stream: "range-partial",
+						Hashes: rangeHashes,
+						Data:   rangeData,
+						Proof:  proof,
+						Next:   2,
+					},
+					Peer: peerID,
+				},
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case hashes := <-delivered:
+		if len(hashes) != 2 {
+			t.Fatalf("expected 2 delivered hashes, got %d", len(hashes))
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for DeliverRange")
+	}
+}
+
+// TestStreamerRangeSyncTamperedProofRejected asserts that a range proof
+// whose sibling hash no longer folds up to the agreed root is rejected:
+// the chunks must never reach DeliverRange unverified.
+func TestStreamerRangeSyncTamperedProofRejected(t *testing.T) {
+	tester, streamer, _, teardown, err := newStreamerTester(t)
+	defer teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash3 := sha3.Sum256([]byte{3})
+	leaves := [][]byte{hash0[:], hash1[:], hash2[:], hash3[:]}
+
+	h01 := merkleSubtreeRoot(leaves[0:2])
+	h23 := merkleSubtreeRoot(leaves[2:4])
+	root := hashPair(h01, h23)
+
+	rangeHashes := leaves[0:2]
+	rangeData := [][]byte{{0}, {1}}
+
+	tamperedSibling := append([]byte{}, h23...)
+	tamperedSibling[0] ^= 0xff
+	proof := &RangeProof{
+		Siblings: []RangeProofSibling{
+			{Hash: tamperedSibling, Left: false},
+		},
+	}
+
+	delivered := make(chan [][]byte, 1)
+	streamer.RegisterIncomingRangeClient("range-tampered", func(p *StreamerPeer, t []byte) (IncomingStreamer, error) {
+		return &testRangeIncomingStreamer{delivered: delivered}, nil
+	})
+	streamer.SetRangeRoot("range-tampered", root)
+
+	peerID := tester.IDs[0]
+
+	err = streamer.RequestRange(peerID, "range-tampered", []byte{}, 0, 2, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "GetChunkRange message",
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 7,
+				Msg: &GetChunkRangeMsg{
+					Stream: "range-tampered",
+					Key:    []byte{},
+					From:   0,
+					To:     2,
+					Limit:  1 << 20,
+				},
+				Peer: peerID,
+			},
+		},
+	},
+		p2ptest.Exchange{
+			Label: "ChunkRange response",
+			Triggers: []p2ptest.Trigger{
+				p2ptest.Trigger{
+					Code: 8,
+					Msg: &ChunkRangeMsg{
+						Stream: "range-tampered",
+						Hashes: rangeHashes,
+						Data:   rangeData,
+						Proof:  proof,
+						Next:   2,
+					},
+					Peer: peerID,
+				},
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-delivered:
+		t.Fatal("expected tampered range proof to be rejected, but DeliverRange was called")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// testRangeOutgoingStreamer is a fake range server: GetRange records the
+// bounds it was called with and returns a fixed, configurable range.
+type testRangeOutgoingStreamer struct {
+	hashes [][]byte
+	data   [][]byte
+	proof  *RangeProof
+	next   uint64
+
+	calledFrom, calledTo uint64
+	called               bool
+}
+
+func (self *testRangeOutgoingStreamer) SetNextBatch(from uint64, to uint64) ([]byte, uint64, uint64, *HandoverProof, error) {
+	return make([]byte, HashSize), from + 1, to + 1, &HandoverProof{Handover: &Handover{}}, nil
+}
+
+func (self *testRangeOutgoingStreamer) GetData([]byte) []byte {
+	return nil
+}
+
+func (self *testRangeOutgoingStreamer) GetRange(from, to uint64, sizeLimit int) ([][]byte, [][]byte, *RangeProof, uint64, error) {
+	self.called = true
+	self.calledFrom, self.calledTo = from, to
+	return self.hashes, self.data, self.proof, self.next, nil
+}
+
+// TestStreamerServeChunkRangeMsg drives the server side of the range
+// exchange over the wire: a RangeRootMsg agrees a root (through
+// handleRangeRootMsg, not SetRangeRoot directly), then a GetChunkRangeMsg
+// triggers handleGetChunkRangeMsg, which must account for the request
+// through subscriptionFunc, call the registered fake range server's
+// GetRange and answer with the three chunks it returns as a
+// ChunkRangeMsg.
+func TestStreamerServeChunkRangeMsg(t *testing.T) {
+	tester, streamer, _, teardown, err := newStreamerTester(t)
+	defer teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rangeHashes := [][]byte{hash0[:], hash1[:], hash2[:]}
+	rangeData := [][]byte{{0}, {1}, {2}}
+	root := merkleSubtreeRoot(rangeHashes)
+
+	server := &testRangeOutgoingStreamer{
+		hashes: rangeHashes,
+		data:   rangeData,
+		proof:  &RangeProof{},
+		next:   3,
+	}
+	streamer.RegisterOutgoingRangeServer("range-serve", func(p *StreamerPeer, key []byte) (OutgoingStreamer, error) {
+		return server, nil
+	})
+
+	peerID := tester.IDs[0]
+
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "RangeRoot message",
+		Triggers: []p2ptest.Trigger{
+			p2ptest.Trigger{
+				Code: 6,
+				Msg: &RangeRootMsg{
+					Stream: "range-serve",
+					Root:   root,
+				},
+				Peer: peerID,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// handleRangeRootMsg is handled inline with no response message, so
+	// give the peer's Run goroutine a moment to process it before relying
+	// on the root being agreed.
+	time.Sleep(50 * time.Millisecond)
+
+	if got := streamer.rangeRoots["range-serve"]; !bytes.Equal(got, root) {
+		t.Fatalf("expected RangeRootMsg to agree root %x, got %x", root, got)
+	}
+
+	err = tester.TestExchanges(p2ptest.Exchange{
+		Label: "GetChunkRange message",
+		Triggers: []p2ptest.Trigger{
+			p2ptest.Trigger{
+				Code: 7,
+				Msg: &GetChunkRangeMsg{
+					Stream: "range-serve",
+					Key:    []byte{},
+					From:   0,
+					To:     3,
+					Limit:  1 << 20,
+				},
+				Peer: peerID,
+			},
+		},
+		Expects: []p2ptest.Expect{
+			p2ptest.Expect{
+				Code: 8,
+				Msg: &ChunkRangeMsg{
+					Stream: "range-serve",
+					Hashes: rangeHashes,
+					Data:   rangeData,
+					Proof:  &RangeProof{},
+					Next:   3,
+				},
+				Peer: peerID,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !server.called {
+		t.Fatal("expected GetRange to be called, it was not")
+	}
+	if server.calledFrom != 0 || server.calledTo != 3 {
+		t.Fatalf("expected GetRange(0, 3, ...), got GetRange(%d, %d, ...)", server.calledFrom, server.calledTo)
+	}
+}
+
 func waitForPeers(streamer *Streamer, timeout time.Duration) error {
 	ticker := time.NewTicker(10 * time.Millisecond)
 	timeoutTimer := time.NewTimer(timeout)
@@ -0,0 +1,5 @@
+// +build !race
+
+package testutil
+
+const RaceEnabled = false